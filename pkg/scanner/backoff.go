@@ -0,0 +1,52 @@
+/*
+Copyright (C) 2018 Synopsys, Inc.
+
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements. See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership. The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License. You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied. See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package scanner
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	finishScanBackoffBase = 500 * time.Millisecond
+	finishScanBackoffCap  = 60 * time.Second
+)
+
+// decorrelatedJitterBackoff computes the next retry delay using the
+// "decorrelated jitter" algorithm: next = random_between(base, prev*3),
+// capped. This spreads retries out more evenly than plain exponential
+// backoff with jitter, which tends to clump retries back together.
+func decorrelatedJitterBackoff(prev time.Duration) time.Duration {
+	if prev < finishScanBackoffBase {
+		prev = finishScanBackoffBase
+	}
+
+	upper := prev * 3
+	if upper > finishScanBackoffCap {
+		upper = finishScanBackoffCap
+	}
+	if upper <= finishScanBackoffBase {
+		return finishScanBackoffBase
+	}
+
+	return finishScanBackoffBase + time.Duration(rand.Int63n(int64(upper-finishScanBackoffBase)))
+}
@@ -0,0 +1,88 @@
+/*
+Copyright (C) 2018 Synopsys, Inc.
+
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements. See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership. The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License. You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied. See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package scanner
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDecorrelatedJitterBackoffBounds(t *testing.T) {
+	tests := []struct {
+		name    string
+		prev    time.Duration
+		wantMin time.Duration
+		wantMax time.Duration
+	}{
+		{
+			name:    "zero previous falls back to base",
+			prev:    0,
+			wantMin: finishScanBackoffBase,
+			wantMax: finishScanBackoffBase * 3,
+		},
+		{
+			name:    "below base falls back to base",
+			prev:    finishScanBackoffBase / 2,
+			wantMin: finishScanBackoffBase,
+			wantMax: finishScanBackoffBase * 3,
+		},
+		{
+			name:    "typical previous triples at most",
+			prev:    5 * time.Second,
+			wantMin: finishScanBackoffBase,
+			wantMax: 15 * time.Second,
+		},
+		{
+			name:    "previous already at cap stays within cap",
+			prev:    finishScanBackoffCap,
+			wantMin: finishScanBackoffBase,
+			wantMax: finishScanBackoffCap,
+		},
+		{
+			name:    "previous far beyond cap is clamped",
+			prev:    finishScanBackoffCap * 10,
+			wantMin: finishScanBackoffBase,
+			wantMax: finishScanBackoffCap,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				got := decorrelatedJitterBackoff(tt.prev)
+				if got < tt.wantMin || got > tt.wantMax {
+					t.Fatalf("decorrelatedJitterBackoff(%s) = %s, want between %s and %s", tt.prev, got, tt.wantMin, tt.wantMax)
+				}
+			}
+		})
+	}
+}
+
+func TestDecorrelatedJitterBackoffNeverExceedsCap(t *testing.T) {
+	prev := finishScanBackoffBase
+	for i := 0; i < 100; i++ {
+		prev = decorrelatedJitterBackoff(prev)
+		if prev > finishScanBackoffCap {
+			t.Fatalf("backoff exceeded cap: %s > %s", prev, finishScanBackoffCap)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+/*
+Copyright (C) 2018 Synopsys, Inc.
+
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements. See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership. The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License. You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied. See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// clairBackendName is the ScanBackend.Name() for the Clair v4 adapter.
+const clairBackendName = "clair"
+
+const clairIndexPollInterval = 2 * time.Second
+
+// clairIndexReportRequest is the body posted to Clair's indexer to kick off
+// analysis of an image manifest.
+type clairIndexReportRequest struct {
+	Hash   string       `json:"hash"`
+	Layers []clairLayer `json:"layers"`
+}
+
+type clairLayer struct {
+	Hash    string            `json:"hash"`
+	URI     string            `json:"uri"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// clairIndexReport mirrors the subset of Clair's IndexReport we care about:
+// whether indexing finished and, if not, whether it failed outright.
+type clairIndexReport struct {
+	State   string `json:"state"`
+	Success bool   `json:"success"`
+	Err     string `json:"err"`
+}
+
+// clairVulnerabilityReport mirrors the subset of Clair's VulnerabilityReport
+// needed to translate it into our normalized Report.
+type clairVulnerabilityReport struct {
+	Vulnerabilities map[string]struct {
+		ID          string `json:"id"`
+		Severity    string `json:"normalized_severity"`
+		Description string `json:"description"`
+	} `json:"vulnerabilities"`
+	Packages map[string]struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	} `json:"packages"`
+}
+
+// ClairScanBackend drives a Clair v4 instance: it submits the image
+// manifest to the indexer, polls until indexing finishes, then fetches and
+// translates the vulnerability report.
+type ClairScanBackend struct {
+	httpClient *http.Client
+	host       string
+	port       int
+}
+
+// NewClairScanBackend ...
+func NewClairScanBackend(host string, port int, httpClient *http.Client) *ClairScanBackend {
+	return &ClairScanBackend{httpClient: httpClient, host: host, port: port}
+}
+
+// Name ...
+func (csb *ClairScanBackend) Name() string {
+	return clairBackendName
+}
+
+// Prepare checks that Clair's indexer is reachable before any image is
+// handed to it, so a misconfigured Clair host fails fast instead of
+// surfacing as a mysterious per-image timeout.
+func (csb *ClairScanBackend) Prepare(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, csb.buildURL("indexer/api/v1/index_state"), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := csb.httpClient.Do(req)
+	if err != nil {
+		recordScannerError("unable to reach clair indexer")
+		return fmt.Errorf("unable to reach clair at %s: %s", csb.host, err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("clair indexer at %s returned status code %d", csb.host, resp.StatusCode)
+	}
+	return nil
+}
+
+// Scan posts the image manifest to Clair, polls the indexer until analysis
+// finishes, then fetches and translates the vulnerability report. It aborts
+// as soon as ctx is cancelled or its deadline elapses.
+func (csb *ClairScanBackend) Scan(ctx context.Context, job ScanJob) (*Report, error) {
+	manifestHash := job.Sha
+
+	reqBody, err := json.Marshal(clairIndexReportRequest{
+		Hash: manifestHash,
+		Layers: []clairLayer{
+			{Hash: manifestHash, URI: job.Repository},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, csb.buildURL("indexer/api/v1/index_report"), bytes.NewBuffer(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := csb.httpClient.Do(req)
+	if err != nil {
+		recordScannerError("unable to POST manifest to clair")
+		return nil, fmt.Errorf("unable to POST manifest to clair: %s", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("POST manifest to clair failed with status code %d", resp.StatusCode)
+	}
+
+	if err := csb.waitForIndex(ctx, manifestHash); err != nil {
+		return nil, err
+	}
+
+	return csb.fetchReport(ctx, manifestHash)
+}
+
+func (csb *ClairScanBackend) waitForIndex(ctx context.Context, manifestHash string) error {
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, csb.buildURL(fmt.Sprintf("indexer/api/v1/index_report/%s", manifestHash)), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := csb.httpClient.Do(req)
+		if err != nil {
+			recordScannerError("unable to GET clair index report")
+			return fmt.Errorf("unable to GET clair index report: %s", err.Error())
+		}
+		bodyBytes, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		var indexReport clairIndexReport
+		if err := json.Unmarshal(bodyBytes, &indexReport); err != nil {
+			recordScannerError("unmarshaling clair index report failed")
+			return fmt.Errorf("unmarshaling clair index report %s failed: %s", string(bodyBytes), err.Error())
+		}
+
+		if indexReport.State == "IndexFinished" {
+			if !indexReport.Success {
+				return fmt.Errorf("clair indexing failed for %s: %s", manifestHash, indexReport.Err)
+			}
+			return nil
+		}
+		if indexReport.Err != "" {
+			return fmt.Errorf("clair indexing failed for %s: %s", manifestHash, indexReport.Err)
+		}
+
+		log.Debugf("clair still indexing %s, state %s", manifestHash, indexReport.State)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("cancelled waiting for clair to index %s", manifestHash)
+		case <-time.After(clairIndexPollInterval):
+		}
+	}
+}
+
+func (csb *ClairScanBackend) fetchReport(ctx context.Context, manifestHash string) (*Report, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, csb.buildURL(fmt.Sprintf("matcher/api/v1/vulnerability_report/%s", manifestHash)), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := csb.httpClient.Do(req)
+	if err != nil {
+		recordScannerError("unable to GET clair vulnerability report")
+		return nil, fmt.Errorf("unable to GET clair vulnerability report: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET clair vulnerability report failed with status code %d", resp.StatusCode)
+	}
+
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var clairReport clairVulnerabilityReport
+	if err := json.Unmarshal(bodyBytes, &clairReport); err != nil {
+		recordScannerError("unmarshaling clair vulnerability report failed")
+		return nil, fmt.Errorf("unmarshaling clair vulnerability report %s failed: %s", string(bodyBytes), err.Error())
+	}
+
+	return translateClairReport(clairReport), nil
+}
+
+func translateClairReport(clairReport clairVulnerabilityReport) *Report {
+	report := &Report{
+		Vulnerabilities: make([]Vulnerability, 0, len(clairReport.Vulnerabilities)),
+		Components:      make([]Component, 0, len(clairReport.Packages)),
+		SeverityCounts:  map[string]int{},
+	}
+	for _, v := range clairReport.Vulnerabilities {
+		report.Vulnerabilities = append(report.Vulnerabilities, Vulnerability{
+			ID:          v.ID,
+			Severity:    v.Severity,
+			Description: v.Description,
+		})
+		report.SeverityCounts[v.Severity]++
+	}
+	for _, p := range clairReport.Packages {
+		report.Components = append(report.Components, Component{Name: p.Name, Version: p.Version})
+	}
+	return report
+}
+
+func (csb *ClairScanBackend) buildURL(path string) string {
+	return fmt.Sprintf("http://%s:%d/%s", csb.host, csb.port, path)
+}
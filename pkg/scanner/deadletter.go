@@ -0,0 +1,137 @@
+/*
+Copyright (C) 2018 Synopsys, Inc.
+
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements. See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership. The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License. You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied. See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package scanner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/blackducksoftware/perceptor/pkg/api"
+	log "github.com/sirupsen/logrus"
+)
+
+const deadLetterReaperInterval = 1 * time.Minute
+
+// deadLetterPath is the file a finished job for a given image is persisted
+// to, so a second failed attempt for the same image overwrites rather than
+// piling up duplicates.
+func (scanner *Scanner) deadLetterPath(results api.FinishedScanClientJob) string {
+	return filepath.Join(scanner.config.Scanner.DeadLetterDir, fmt.Sprintf("%s.json", results.ImageSpec.Sha))
+}
+
+// deadLetter persists results to Scanner.DeadLetterDir once finishScan has
+// exhausted its retry budget, so a finished scan is never silently dropped
+// just because perceptor was unreachable.
+func (scanner *Scanner) deadLetter(results api.FinishedScanClientJob) error {
+	dir := scanner.config.Scanner.DeadLetterDir
+	if dir == "" {
+		return fmt.Errorf("no dead-letter directory configured, dropping finished job for %s", results.ImageSpec.Sha)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("unable to create dead-letter directory %s: %s", dir, err.Error())
+	}
+
+	jsonBytes, err := json.Marshal(results)
+	if err != nil {
+		return err
+	}
+
+	path := scanner.deadLetterPath(results)
+	if err := ioutil.WriteFile(path, jsonBytes, 0644); err != nil {
+		return fmt.Errorf("unable to write dead-letter file %s: %s", path, err.Error())
+	}
+
+	log.Warnf("dead-lettered finished job for %s to %s after exhausting retries", results.ImageSpec.Sha, path)
+	return nil
+}
+
+// StartDeadLetterReaper periodically retries dead-lettered finished-scan
+// jobs until stop fires, so a job only dead-lettered because perceptor was
+// briefly down still gets delivered once perceptor comes back.
+func (scanner *Scanner) StartDeadLetterReaper() {
+	if scanner.config.Scanner.DeadLetterDir == "" {
+		return
+	}
+
+	go func() {
+		for {
+			select {
+			case <-scanner.ctx.Done():
+				return
+			case <-time.After(deadLetterReaperInterval):
+				scanner.reapDeadLetters()
+			}
+		}
+	}()
+}
+
+func (scanner *Scanner) reapDeadLetters() {
+	dir := scanner.config.Scanner.DeadLetterDir
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("unable to read dead-letter directory %s: %s", dir, err.Error())
+		}
+		return
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		scanner.reapDeadLetterFile(filepath.Join(dir, entry.Name()))
+	}
+}
+
+func (scanner *Scanner) reapDeadLetterFile(path string) {
+	jsonBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Errorf("unable to read dead-lettered job %s: %s", path, err.Error())
+		return
+	}
+
+	var results api.FinishedScanClientJob
+	if err := json.Unmarshal(jsonBytes, &results); err != nil {
+		log.Errorf("unable to unmarshal dead-lettered job %s: %s", path, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(scanner.ctx, time.Duration(scanner.config.Scanner.HTTPTimeout)*time.Second)
+	defer cancel()
+
+	if err := scanner.postFinishedScan(ctx, results); err != nil {
+		log.Debugf("perceptor still unavailable, leaving %s dead-lettered: %s", path, err.Error())
+		return
+	}
+
+	if err := os.Remove(path); err != nil {
+		log.Errorf("unable to remove reaped dead-letter file %s: %s", path, err.Error())
+		return
+	}
+	log.Infof("successfully resent dead-lettered job %s", path)
+}
@@ -0,0 +1,205 @@
+/*
+Copyright (C) 2018 Synopsys, Inc.
+
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements. See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership. The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License. You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied. See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package scanner
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	scanDurationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "perceptor",
+		Subsystem: "scanner",
+		Name:      "scan_duration_seconds",
+		Help:      "time spent scanning a single image, by backend",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"backend"})
+
+	tarballSizeBytes = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "perceptor",
+		Subsystem: "scanner",
+		Name:      "tarball_size_bytes",
+		Help:      "size of image tarballs pulled for scanning",
+		Buckets:   prometheus.ExponentialBuckets(1<<20, 2, 10),
+	})
+
+	downloadDurationSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "perceptor",
+		Subsystem: "scanner",
+		Name:      "download_duration_seconds",
+		Help:      "time spent pulling an image tarball from the image facade",
+		Buckets:   prometheus.DefBuckets,
+	})
+)
+
+func init() {
+	prometheus.MustRegister(scanDurationSeconds, tarballSizeBytes, downloadDurationSeconds)
+}
+
+// startMetricsServer starts the /metrics, /healthz, and /readyz endpoints
+// on Scanner.MetricsPort. It is a no-op if MetricsPort is unset, so
+// existing deployments that don't wire up a port keep working unchanged.
+func (scanner *Scanner) startMetricsServer() {
+	port := scanner.config.Scanner.MetricsPort
+	if port == 0 {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", scanner.handleHealthz)
+	mux.HandleFunc("/readyz", scanner.handleReadyz)
+
+	server := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: mux}
+
+	go func() {
+		log.Infof("starting metrics server on port %d", port)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Errorf("metrics server exited unexpectedly: %s", err.Error())
+		}
+	}()
+
+	go func() {
+		<-scanner.ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Errorf("unable to shut down metrics server cleanly: %s", err.Error())
+		}
+	}()
+}
+
+// handleHealthz reports liveness: the process is up and serving.
+func (scanner *Scanner) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// handleReadyz reports readiness: the image-facade and perceptor are
+// reachable, every hub a scan client has been downloaded for is itself
+// reachable, and -- if any image has asked this scanner to talk to a Black
+// Duck hub -- at least one hub's scan client has finished downloading. This
+// lets Kubernetes hold traffic back from a pod whose scan client download is
+// wedged, without forcing a scanner that only runs the Clair backend to
+// wait on a hub client it was never asked to download.
+func (scanner *Scanner) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if err := scanner.checkReady(); err != nil {
+		log.Debugf("not ready: %s", err.Error())
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "not ready: %s", err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "ready")
+}
+
+func (scanner *Scanner) checkReady() error {
+	if err := checkTCPReachable(scanner.perceptorHost, scanner.perceptorPort); err != nil {
+		return fmt.Errorf("perceptor unreachable: %s", err.Error())
+	}
+
+	if err := checkTCPReachable(scanner.config.ImageFacade.GetHost(), scanner.config.ImageFacade.Port); err != nil {
+		return fmt.Errorf("image facade unreachable: %s", err.Error())
+	}
+
+	hubRequested, hubDownloaded, hubURLs := scanner.hubClientStatus()
+
+	if err := checkHubsReachable(hubURLs); err != nil {
+		return err
+	}
+
+	if hubRequested && !hubDownloaded {
+		return fmt.Errorf("a hub scan client has been requested but none has finished downloading yet")
+	}
+
+	return nil
+}
+
+func checkTCPReachable(host string, port int) error {
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", host, port), 2*time.Second)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	return nil
+}
+
+// checkHubsReachable dials every hub URL concurrently and returns as soon as
+// all dials have completed. Dialing sequentially would make /readyz take a
+// multiple of 2s per cached hub, which can blow past a Kubernetes
+// readinessProbe timeout once a scanner pod has a handful of hubs cached.
+func checkHubsReachable(hubURLs []string) error {
+	errs := make(chan error, len(hubURLs))
+	for _, hubURL := range hubURLs {
+		hubURL := hubURL
+		go func() {
+			if err := checkHubReachable(hubURL); err != nil {
+				errs <- fmt.Errorf("hub %s unreachable: %s", hubURL, err.Error())
+				return
+			}
+			errs <- nil
+		}()
+	}
+
+	var firstErr error
+	for range hubURLs {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// checkHubReachable dials the host:port embedded in a Black Duck hub URL,
+// defaulting the port to the URL scheme's when none is given.
+func checkHubReachable(hubURL string) error {
+	parsed, err := url.Parse(hubURL)
+	if err != nil {
+		return fmt.Errorf("invalid hub URL: %s", err.Error())
+	}
+
+	port := parsed.Port()
+	if port == "" {
+		if parsed.Scheme == "https" {
+			port = "443"
+		} else {
+			port = "80"
+		}
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(parsed.Hostname(), port), 2*time.Second)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	return nil
+}
@@ -0,0 +1,142 @@
+/*
+Copyright (C) 2018 Synopsys, Inc.
+
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements. See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership. The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License. You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied. See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package scanner
+
+import (
+	"container/heap"
+	"sync"
+
+	"github.com/blackducksoftware/perceptor/pkg/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// queuedImage pairs an image slated for scanning with the outcome of its
+// tarball pre-fetch, so a scan worker can wait on the pull without blocking
+// whichever worker dequeues it next.
+type queuedImage struct {
+	spec     *api.ImageSpec
+	pullDone chan error
+}
+
+// imageHeap is a container/heap.Interface over queuedImages, ordered so the
+// highest api.ImageSpec.Priority pops first.
+type imageHeap []*queuedImage
+
+func (h imageHeap) Len() int            { return len(h) }
+func (h imageHeap) Less(i, j int) bool  { return h[i].spec.Priority > h[j].spec.Priority }
+func (h imageHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *imageHeap) Push(x interface{}) { *h = append(*h, x.(*queuedImage)) }
+func (h *imageHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
+
+// imageQueue is a bounded, priority-ordered queue of images awaiting a scan
+// worker. When full, a newly pushed image preempts the lowest-priority
+// queued image if it outranks it; otherwise it is dropped.
+type imageQueue struct {
+	mu       sync.Mutex
+	notEmpty *sync.Cond
+	items    imageHeap
+	maxDepth int
+}
+
+// newImageQueue ...
+func newImageQueue(maxDepth int) *imageQueue {
+	if maxDepth <= 0 {
+		log.Warnf("Scanner.MaxQueueDepth is %d, treating image queue as unbounded", maxDepth)
+	}
+	q := &imageQueue{items: imageHeap{}, maxDepth: maxDepth}
+	q.notEmpty = sync.NewCond(&q.mu)
+	return q
+}
+
+// Push adds qi to the queue, evicting the current lowest-priority entry if
+// the queue is at maxDepth and qi outranks it. Returns false if qi was
+// dropped instead of queued, in which case qi is returned as evicted so the
+// caller can clean up anything it already started for it (e.g. a tarball
+// pull). If qi preempted a lower-priority entry instead, that entry is
+// returned as evicted so the caller can clean it up the same way. maxDepth
+// <= 0 is treated as unbounded, since that's also the Go zero value for an
+// unset Scanner.MaxQueueDepth.
+func (q *imageQueue) Push(qi *queuedImage) (pushed bool, evicted *queuedImage) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.maxDepth > 0 && len(q.items) >= q.maxDepth {
+		lowest := q.lowestPriorityIndex()
+		if q.items[lowest].spec.Priority >= qi.spec.Priority {
+			return false, qi
+		}
+		evicted = heap.Remove(&q.items, lowest).(*queuedImage)
+	}
+
+	heap.Push(&q.items, qi)
+	q.notEmpty.Signal()
+	return true, evicted
+}
+
+// Pop blocks until an image is available or stop is closed, in which case
+// it returns (nil, false).
+func (q *imageQueue) Pop(stop <-chan struct{}) (*queuedImage, bool) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-stop:
+			q.mu.Lock()
+			q.notEmpty.Broadcast()
+			q.mu.Unlock()
+		case <-done:
+		}
+	}()
+	defer close(done)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.items) == 0 {
+		select {
+		case <-stop:
+			return nil, false
+		default:
+		}
+		q.notEmpty.Wait()
+		select {
+		case <-stop:
+			return nil, false
+		default:
+		}
+	}
+	return heap.Pop(&q.items).(*queuedImage), true
+}
+
+func (q *imageQueue) lowestPriorityIndex() int {
+	lowest := 0
+	for i := 1; i < len(q.items); i++ {
+		if q.items[i].spec.Priority < q.items[lowest].spec.Priority {
+			lowest = i
+		}
+	}
+	return lowest
+}
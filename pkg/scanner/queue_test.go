@@ -0,0 +1,155 @@
+/*
+Copyright (C) 2018 Synopsys, Inc.
+
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements. See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership. The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License. You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied. See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package scanner
+
+import (
+	"testing"
+
+	"github.com/blackducksoftware/perceptor/pkg/api"
+)
+
+func imageWithPriority(sha string, priority int) *queuedImage {
+	return &queuedImage{spec: &api.ImageSpec{Sha: sha, Priority: priority}}
+}
+
+func TestImageQueuePopsHighestPriorityFirst(t *testing.T) {
+	q := newImageQueue(10)
+
+	q.Push(imageWithPriority("low", 1))
+	q.Push(imageWithPriority("high", 5))
+	q.Push(imageWithPriority("medium", 3))
+
+	wantOrder := []string{"high", "medium", "low"}
+	for _, want := range wantOrder {
+		qi, ok := q.Pop(nil)
+		if !ok {
+			t.Fatalf("Pop() returned ok=false, want an image")
+		}
+		if qi.spec.Sha != want {
+			t.Errorf("Pop() = %q, want %q", qi.spec.Sha, want)
+		}
+	}
+}
+
+func TestImageQueuePushAtCapacity(t *testing.T) {
+	tests := []struct {
+		name           string
+		maxDepth       int
+		existing       []int
+		pushPriority   int
+		wantPushed     bool
+		wantDepth      int
+		wantEvictedSha string
+	}{
+		{
+			name:           "higher priority evicts the lowest",
+			maxDepth:       2,
+			existing:       []int{1, 2},
+			pushPriority:   3,
+			wantPushed:     true,
+			wantDepth:      2,
+			wantEvictedSha: "a",
+		},
+		{
+			name:         "lower priority is dropped",
+			maxDepth:     2,
+			existing:     []int{1, 2},
+			pushPriority: 0,
+			wantPushed:   false,
+			wantDepth:    2,
+		},
+		{
+			name:         "equal priority is dropped",
+			maxDepth:     2,
+			existing:     []int{1, 2},
+			pushPriority: 1,
+			wantPushed:   false,
+			wantDepth:    2,
+		},
+		{
+			name:         "below capacity always pushes",
+			maxDepth:     5,
+			existing:     []int{1},
+			pushPriority: 0,
+			wantPushed:   true,
+			wantDepth:    2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newImageQueue(tt.maxDepth)
+			for i, priority := range tt.existing {
+				q.Push(imageWithPriority(string(rune('a'+i)), priority))
+			}
+
+			pushed, evicted := q.Push(imageWithPriority("new", tt.pushPriority))
+			if pushed != tt.wantPushed {
+				t.Errorf("Push() pushed = %t, want %t", pushed, tt.wantPushed)
+			}
+			if len(q.items) != tt.wantDepth {
+				t.Errorf("len(q.items) = %d, want %d", len(q.items), tt.wantDepth)
+			}
+
+			switch {
+			case tt.wantEvictedSha != "":
+				if evicted == nil || evicted.spec.Sha != tt.wantEvictedSha {
+					t.Errorf("Push() evicted = %+v, want sha %q", evicted, tt.wantEvictedSha)
+				}
+			case !tt.wantPushed:
+				if evicted == nil || evicted.spec.Sha != "new" {
+					t.Errorf("Push() evicted = %+v, want the rejected item itself", evicted)
+				}
+			default:
+				if evicted != nil {
+					t.Errorf("Push() evicted = %+v, want nil", evicted)
+				}
+			}
+		})
+	}
+}
+
+func TestImageQueueNonPositiveMaxDepthIsUnbounded(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxDepth int
+	}{
+		{name: "zero value", maxDepth: 0},
+		{name: "negative", maxDepth: -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newImageQueue(tt.maxDepth)
+
+			for i := 0; i < 5; i++ {
+				if pushed, _ := q.Push(imageWithPriority(string(rune('a'+i)), i)); !pushed {
+					t.Fatalf("Push() returned false for item %d, want true (unbounded queue)", i)
+				}
+			}
+
+			if len(q.items) != 5 {
+				t.Errorf("len(q.items) = %d, want 5", len(q.items))
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+/*
+Copyright (C) 2018 Synopsys, Inc.
+
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements. See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership. The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License. You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied. See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package scanner
+
+import (
+	"context"
+	"os"
+)
+
+// blackDuckBackendName is the ScanBackend.Name() used for the existing
+// Black Duck hub scan client, and the default when an image does not
+// request a backend explicitly.
+const blackDuckBackendName = "blackduck"
+
+// Vulnerability is a single finding, normalized across scan engines.
+type Vulnerability struct {
+	ID          string
+	Severity    string
+	Description string
+}
+
+// Component is a piece of software identified in the scanned image,
+// normalized across scan engines.
+type Component struct {
+	Name    string
+	Version string
+}
+
+// Report is a scan result in a form common to every ScanBackend, so that
+// perceptor does not need to know which engine produced it.
+type Report struct {
+	Vulnerabilities []Vulnerability
+	Components      []Component
+	SeverityCounts  map[string]int
+}
+
+// ScanBackend is implemented by each scan engine the scanner knows how to
+// drive. Scanner selects a backend per image, so a single scanner pod can
+// mix engines (e.g. Black Duck and Clair) across its workload.
+type ScanBackend interface {
+	// Name identifies the backend in FinishedScanClientJob so perceptor can
+	// record which engine produced a given report.
+	Name() string
+	// Prepare readies the backend to scan (e.g. checking connectivity); it
+	// is called before the first Scan and is safe to call more than once.
+	Prepare(ctx context.Context) error
+	// Scan runs job, aborting early if ctx is cancelled or its deadline
+	// (Scanner.ScanTimeout) elapses.
+	Scan(ctx context.Context, job ScanJob) (*Report, error)
+}
+
+// HubScanBackend adapts the existing Black Duck ScanClientInterface to
+// ScanBackend so it can be dispatched alongside other scan engines.
+//
+// scanClient is cached per (hubURL, user) and can outlive any single image,
+// so HubScanBackend carries the hub password for the *current* image and
+// re-applies it at Scan time -- NewHubScanClient takes no password, so
+// BD_HUB_PASSWORD is the only channel by which credentials reach the
+// underlying CLI, and it must be set freshly for every job, not just the
+// first time a given hub's client is downloaded.
+type HubScanBackend struct {
+	scanClient  ScanClientInterface
+	hubPassword string
+}
+
+// NewHubScanBackend ...
+func NewHubScanBackend(scanClient ScanClientInterface, hubPassword string) *HubScanBackend {
+	return &HubScanBackend{scanClient: scanClient, hubPassword: hubPassword}
+}
+
+// Name ...
+func (hsb *HubScanBackend) Name() string {
+	return blackDuckBackendName
+}
+
+// Prepare is a no-op: the hub scan client is already downloaded and ready
+// to go by the time it is wrapped in a HubScanBackend.
+func (hsb *HubScanBackend) Prepare(ctx context.Context) error {
+	return nil
+}
+
+// Scan runs the Black Duck CLI scan client. The client does not hand back a
+// structured report -- perceptor pulls vulnerability data from the hub
+// directly once the hub project scan completes -- so Scan returns an empty
+// Report on success and lets the caller record which backend ran.
+func (hsb *HubScanBackend) Scan(ctx context.Context, job ScanJob) (*Report, error) {
+	if err := os.Setenv("BD_HUB_PASSWORD", hsb.hubPassword); err != nil {
+		return nil, err
+	}
+
+	err := hsb.scanClient.Scan(ctx, job)
+	if err != nil {
+		return nil, err
+	}
+	return &Report{}, nil
+}
@@ -23,98 +23,212 @@ package scanner
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/blackducksoftware/perceptor/pkg/api"
 	log "github.com/sirupsen/logrus"
 )
 
-const (
-	requestScanJobPause = 20 * time.Second
-)
-
 // Scanner ...
 type Scanner struct {
-	scanClient    ScanClientInterface
-	httpClient    *http.Client
-	perceptorHost string
-	perceptorPort int
-	config        *Config
-	stop          <-chan struct{}
-	hubPassword   string
+	scanClients         map[string]ScanClientInterface
+	scanClientsMu       sync.Mutex
+	scanClientDownloads *keyedMutex
+	hubClientRequested  bool
+	clairBackend        *ClairScanBackend
+	imagePuller         *ImageFacadePuller
+	queue               *imageQueue
+	httpClient          *http.Client
+	perceptorHost       string
+	perceptorPort       int
+	config              *Config
+	ctx                 context.Context
 }
 
 // NewScanner ...
 func NewScanner(config *Config, stop <-chan struct{}) (*Scanner, error) {
 	log.Infof("instantiating Scanner with config %+v", config)
 
-	hubPassword, ok := os.LookupEnv(config.Hub.PasswordEnvVar)
-	if !ok {
-		return nil, fmt.Errorf("unable to get Hub password: environment variable %s not set", config.Hub.PasswordEnvVar)
-	}
-
-	err := os.Setenv("BD_HUB_PASSWORD", hubPassword)
-	if err != nil {
-		log.Errorf("unable to set BD_HUB_PASSWORD environment variable: %s", err.Error())
-		return nil, err
-	}
+	httpClient := &http.Client{Timeout: time.Duration(config.Scanner.HTTPTimeout) * time.Second}
 
-	httpClient := &http.Client{Timeout: 5 * time.Second}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
 
 	scanner := Scanner{
-		scanClient:    nil,
-		httpClient:    httpClient,
-		perceptorHost: config.Perceptor.Host,
-		perceptorPort: config.Perceptor.Port,
-		config:        config,
-		stop:          stop,
-		hubPassword:   hubPassword}
+		scanClients:         map[string]ScanClientInterface{},
+		scanClientDownloads: newKeyedMutex(),
+		clairBackend:        NewClairScanBackend(config.Clair.Host, config.Clair.Port, httpClient),
+		imagePuller:         NewImageFacadePuller(config.ImageFacade.GetHost(), config.ImageFacade.Port),
+		queue:               newImageQueue(config.Scanner.MaxQueueDepth),
+		httpClient:          httpClient,
+		perceptorHost:       config.Perceptor.Host,
+		perceptorPort:       config.Perceptor.Port,
+		config:              config,
+		ctx:                 ctx}
+
+	scanner.startMetricsServer()
 
 	return &scanner, nil
 }
 
-// StartRequestingScanJobs will start asking for work
+// StartRequestingScanJobs starts a fetch loop that polls perceptor for work
+// and a pool of Scanner.Workers scan workers that pull from a bounded,
+// priority-ordered local queue. Running these concurrently, instead of one
+// request-scan-finish cycle at a time, lets a fully loaded hub and
+// image-facade keep several images moving through pull-then-scan at once.
 func (scanner *Scanner) StartRequestingScanJobs() {
-	log.Infof("starting to request scan jobs")
-	go func() {
-		for {
-			select {
-			case <-scanner.stop:
-				return
-			case <-time.After(requestScanJobPause):
-				err := scanner.requestAndRunScanJob()
-				if err != nil {
-					log.Errorf("unable to run requestAndRunScanJob: %s", err.Error())
-				}
+	workers := scanner.config.Scanner.Workers
+	if workers <= 0 {
+		log.Warnf("Scanner.Workers is %d, defaulting to 1 worker", workers)
+		workers = 1
+	}
+
+	log.Infof("starting to request scan jobs with %d workers, queue depth %d", workers, scanner.config.Scanner.MaxQueueDepth)
+
+	go scanner.fetchLoop()
+	scanner.StartDeadLetterReaper()
+
+	for i := 0; i < workers; i++ {
+		go scanner.scanWorker(i)
+	}
+}
+
+// fetchLoop polls perceptor for the next image on Scanner.PollInterval and
+// enqueues whatever it gets back.
+func (scanner *Scanner) fetchLoop() {
+	pollInterval := time.Duration(scanner.config.Scanner.PollInterval) * time.Second
+	for {
+		select {
+		case <-scanner.ctx.Done():
+			return
+		case <-time.After(pollInterval):
+			image, err := scanner.requestScanJob(scanner.ctx)
+			if err != nil {
+				log.Errorf("unable to request scan job: %s", err.Error())
+				continue
 			}
+			if image == nil {
+				continue
+			}
+			scanner.enqueueImage(image)
 		}
+	}
+}
+
+// enqueueImage queues image for a scan worker and, once it's actually
+// queued, kicks off its tarball pull in the background so the pull overlaps
+// with whatever the worker pool is currently scanning instead of starting
+// only once a worker is free. The pull is deliberately not started until
+// Push succeeds, and any entry Push evicts to make room is cleaned up too,
+// so a dropped or preempted job never leaves an orphaned tarball on disk.
+func (scanner *Scanner) enqueueImage(image *api.ImageSpec) {
+	queued := &queuedImage{spec: image, pullDone: make(chan error, 1)}
+
+	pushed, evicted := scanner.queue.Push(queued)
+	if !pushed {
+		log.Warnf("dropping scan job for %s: queue is full at depth %d", image.Sha, scanner.config.Scanner.MaxQueueDepth)
+		return
+	}
+
+	go func() {
+		queued.pullDone <- scanner.pullImage(image)
 	}()
+
+	if evicted != nil {
+		log.Warnf("evicting lower-priority scan job for %s to make room for %s", evicted.spec.Sha, image.Sha)
+		scanner.discardQueuedImage(evicted)
+	}
 }
 
-func (scanner *Scanner) downloadScanner(hubURL string) (ScanClientInterface, error) {
+// discardQueuedImage cleans up the on-disk tarball for a queuedImage that
+// was evicted before a worker could scan it. It waits for that image's
+// in-flight pull to finish so it removes the tarball the pull leaves behind
+// instead of racing it.
+func (scanner *Scanner) discardQueuedImage(qi *queuedImage) {
+	go func() {
+		if err := <-qi.pullDone; err != nil {
+			return
+		}
+		if err := scanner.imagePuller.RemoveImage(qi.spec); err != nil {
+			log.Errorf("unable to clean up tarball for evicted scan job %s: %s", qi.spec.Sha, err.Error())
+		}
+	}()
+}
+
+// pullImage pulls image's tarball via the image facade, recording the pull
+// duration and the resulting tarball size.
+func (scanner *Scanner) pullImage(image *api.ImageSpec) error {
+	start := time.Now()
+	size, err := scanner.imagePuller.PullImage(image)
+	downloadDurationSeconds.Observe(time.Since(start).Seconds())
+	if err == nil {
+		tarballSizeBytes.Observe(float64(size))
+	}
+	return err
+}
+
+// scanWorker pulls images off the queue and scans them until stop fires.
+func (scanner *Scanner) scanWorker(id int) {
+	for {
+		queued, ok := scanner.queue.Pop(scanner.ctx.Done())
+		if !ok {
+			return
+		}
+
+		if err := <-queued.pullDone; err != nil {
+			log.Errorf("worker %d: unable to pull tarball for %s: %s", id, queued.spec.Sha, err.Error())
+		}
+
+		if err := scanner.runScanJob(queued.spec); err != nil {
+			log.Errorf("worker %d: unable to run scan job: %s", id, err.Error())
+		}
+	}
+}
+
+// hubScanClientKey identifies a cached scan client by the hub it talks to
+// and the user it authenticates as, since two images can reference the
+// same hub under different credentials.
+func hubScanClientKey(hubURL string, hubUser string) string {
+	return fmt.Sprintf("%s|%s", hubURL, hubUser)
+}
+
+func (scanner *Scanner) downloadScanner(image *api.ImageSpec) (ScanClientInterface, error) {
 	config := scanner.config
+
+	err := os.Setenv("BD_HUB_PASSWORD", image.HubPassword)
+	if err != nil {
+		log.Errorf("unable to set BD_HUB_PASSWORD environment variable: %s", err.Error())
+		return nil, err
+	}
+
 	scanClientInfo, err := downloadScanClient(
-		hubURL,
-		config.Hub.User,
-		scanner.hubPassword,
-		config.Hub.Port,
+		image.HubURL,
+		image.HubUser,
+		image.HubPassword,
+		image.HubPort,
 		time.Duration(config.Hub.ClientTimeoutSeconds)*time.Second)
 	if err != nil {
 		log.Errorf("unable to download scan client: %s", err.Error())
 		return nil, err
 	}
 
-	log.Infof("instantiating scanner with hub %s, user %s", hubURL, config.Hub.User)
+	log.Infof("instantiating scanner with hub %s, user %s", image.HubURL, image.HubUser)
 
 	imagePuller := NewImageFacadePuller(config.ImageFacade.GetHost(), config.ImageFacade.Port)
 	scanClient, err := NewHubScanClient(
-		config.Hub.User,
-		config.Hub.Port,
+		image.HubUser,
+		image.HubPort,
 		scanClientInfo,
 		imagePuller)
 	if err != nil {
@@ -124,47 +238,165 @@ func (scanner *Scanner) downloadScanner(hubURL string) (ScanClientInterface, err
 	return scanClient, nil
 }
 
-func (scanner *Scanner) requestAndRunScanJob() error {
-	log.Debug("requesting scan job")
-	image, err := scanner.requestScanJob()
+// getScanClient returns the cached scan client for the hub and user carried
+// on image, downloading and instantiating one the first time that
+// (hubURL, user) pair is seen. This lets a single scanner pod service many
+// Black Duck hubs concurrently instead of pinning to whichever hub the
+// first scan job happened to reference: scanClientsMu only ever guards the
+// map itself, so a slow download for one hub never blocks a cache lookup --
+// or a download -- for a different hub. Concurrent first-time downloads for
+// the *same* hub are serialized by a per-key lock instead of the map lock,
+// so only one of them actually hits the network.
+func (scanner *Scanner) getScanClient(image *api.ImageSpec) (ScanClientInterface, error) {
+	key := hubScanClientKey(image.HubURL, image.HubUser)
+
+	scanner.scanClientsMu.Lock()
+	scanner.hubClientRequested = true
+	scanner.scanClientsMu.Unlock()
+
+	if scanClient, ok := scanner.lookupScanClient(key); ok {
+		return scanClient, nil
+	}
+
+	unlock := scanner.scanClientDownloads.Lock(key)
+	defer unlock()
+
+	// Re-check now that we hold the per-key lock: another goroutine may
+	// have finished downloading this hub's client while we were waiting.
+	if scanClient, ok := scanner.lookupScanClient(key); ok {
+		return scanClient, nil
+	}
+
+	scanClient, err := scanner.downloadScanner(image)
 	if err != nil {
-		log.Errorf("unable to request scan job: %s", err.Error())
-		return err
+		return nil, err
 	}
-	if image == nil {
-		log.Debug("requested scan job, got nil")
-		return nil
+
+	scanner.scanClientsMu.Lock()
+	scanner.scanClients[key] = scanClient
+	scanner.scanClientsMu.Unlock()
+	return scanClient, nil
+}
+
+func (scanner *Scanner) lookupScanClient(key string) (ScanClientInterface, bool) {
+	scanner.scanClientsMu.Lock()
+	defer scanner.scanClientsMu.Unlock()
+	scanClient, ok := scanner.scanClients[key]
+	return scanClient, ok
+}
+
+// hubClientStatus reports whether any image has asked this scanner to talk
+// to a Black Duck hub, whether at least one such hub's scan client has
+// finished downloading, and the hub URLs currently cached -- so /readyz can
+// fail a pod that's expected to scan against Black Duck but whose download
+// is wedged, without blocking a Clair-only pod that was never asked to.
+func (scanner *Scanner) hubClientStatus() (requested bool, downloaded bool, hubURLs []string) {
+	scanner.scanClientsMu.Lock()
+	defer scanner.scanClientsMu.Unlock()
+
+	hubURLs = make([]string, 0, len(scanner.scanClients))
+	for key := range scanner.scanClients {
+		hubURLs = append(hubURLs, strings.SplitN(key, "|", 2)[0])
 	}
+	return scanner.hubClientRequested, len(scanner.scanClients) > 0, hubURLs
+}
 
-	log.Infof("processing scan job %+v", image)
-	if scanner.scanClient == nil {
-		scanClient, err := scanner.downloadScanner(image.HubURL)
+// getScanBackend selects the ScanBackend for an image: the Black Duck hub
+// client it references, unless the image asks for a different engine by
+// name, in which case that engine runs instead (or alongside, for an
+// operator that wants both -- a second request with Backend set to the
+// other name). Defaulting to Black Duck keeps existing perceptor deployments
+// working without setting anything new on ImageSpec.
+func (scanner *Scanner) getScanBackend(image *api.ImageSpec) (ScanBackend, error) {
+	switch image.Backend {
+	case "", blackDuckBackendName:
+		scanClient, err := scanner.getScanClient(image)
 		if err != nil {
-			log.Errorf("unable to download scan client from %s: %s", image.HubURL, err.Error())
-			return err
+			return nil, err
+		}
+		return NewHubScanBackend(scanClient, image.HubPassword), nil
+	case clairBackendName:
+		return scanner.clairBackend, nil
+	default:
+		return nil, fmt.Errorf("unknown scan backend %q", image.Backend)
+	}
+}
+
+// runScanJob scans an already-fetched image and reports the outcome back to
+// perceptor. The scan is bounded by Scanner.ScanTimeout and aborts early if
+// the scanner is stopped; in the latter case the partially-downloaded
+// tarball is cleaned up and perceptor is told the job was cancelled so it
+// can reschedule the image instead of the slot leaking forever.
+func (scanner *Scanner) runScanJob(image *api.ImageSpec) error {
+	log.Infof("processing scan job %+v", image)
+	backend, err := scanner.getScanBackend(image)
+	if err != nil {
+		log.Errorf("unable to get scan backend for image %+v: %s", image, err.Error())
+		return err
+	}
+
+	jobCtx, cancel := context.WithTimeout(scanner.ctx, time.Duration(scanner.config.Scanner.ScanTimeout)*time.Second)
+	defer cancel()
+
+	if err := backend.Prepare(jobCtx); err != nil {
+		if scanner.ctx.Err() != nil {
+			log.Warnf("scanner is stopping, reporting %s as cancelled instead of retrying", image.Sha)
+			scanner.reportCancelled(image, backend.Name())
+			return scanner.ctx.Err()
 		}
-		scanner.scanClient = scanClient
+		log.Errorf("unable to prepare %s scan backend: %s", backend.Name(), err.Error())
+		return err
 	}
 
 	job := NewScanJob(image.Repository, image.Sha, image.HubURL, image.HubProjectName, image.HubProjectVersionName, image.HubScanName)
-	err = scanner.scanClient.Scan(*job)
+	scanStart := time.Now()
+	report, err := backend.Scan(jobCtx, *job)
+	scanDurationSeconds.WithLabelValues(backend.Name()).Observe(time.Since(scanStart).Seconds())
+
+	if err != nil && scanner.ctx.Err() != nil {
+		log.Warnf("scanner is stopping, reporting %s as cancelled instead of retrying", image.Sha)
+		scanner.reportCancelled(image, backend.Name())
+		return scanner.ctx.Err()
+	}
+
 	errorString := ""
 	if err != nil {
 		errorString = err.Error()
 	}
 
-	finishedJob := api.FinishedScanClientJob{Err: errorString, ImageSpec: *image}
+	finishedJob := api.FinishedScanClientJob{Err: errorString, ImageSpec: *image, Backend: backend.Name(), Report: report}
 	log.Infof("about to finish job, going to send over %+v", finishedJob)
-	err = scanner.finishScan(finishedJob)
+	err = scanner.finishScan(scanner.ctx, finishedJob)
 	if err != nil {
 		log.Errorf("unable to finish scan job: %s", err.Error())
 	}
 	return err
 }
 
-func (scanner *Scanner) requestScanJob() (*api.ImageSpec, error) {
+// reportCancelled cleans up the on-disk tarball for an image whose scan was
+// aborted because the scanner is stopping, and makes a single best-effort
+// attempt to tell perceptor so it can reschedule the image.
+func (scanner *Scanner) reportCancelled(image *api.ImageSpec, backendName string) {
+	if err := scanner.imagePuller.RemoveImage(image); err != nil {
+		log.Errorf("unable to clean up tarball for %s after cancellation: %s", image.Sha, err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(scanner.config.Scanner.HTTPTimeout)*time.Second)
+	defer cancel()
+
+	finishedJob := api.FinishedScanClientJob{Err: "cancelled", ImageSpec: *image, Backend: backendName}
+	if err := scanner.postFinishedScan(ctx, finishedJob); err != nil {
+		log.Errorf("unable to report cancelled scan for %s: %s", image.Sha, err.Error())
+	}
+}
+
+func (scanner *Scanner) requestScanJob(ctx context.Context) (*api.ImageSpec, error) {
 	nextImageURL := scanner.buildURL(api.NextImagePath)
-	resp, err := scanner.httpClient.Post(nextImageURL, "", bytes.NewBuffer([]byte{}))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, nextImageURL, bytes.NewBuffer([]byte{}))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := scanner.httpClient.Do(req)
 
 	if err != nil {
 		recordScannerError("unable to POST get next image")
@@ -204,7 +436,51 @@ func (scanner *Scanner) requestScanJob() (*api.ImageSpec, error) {
 	return nextImage.ImageSpec, nil
 }
 
-func (scanner *Scanner) finishScan(results api.FinishedScanClientJob) error {
+// finishScan reports a finished job to perceptor, retrying with capped
+// exponential backoff and decorrelated jitter up to Scanner.FinishScanMaxAttempts
+// or Scanner.FinishScanMaxElapsed, whichever comes first. Once either is
+// exhausted, the job is dead-lettered to Scanner.DeadLetterDir instead of
+// being dropped.
+func (scanner *Scanner) finishScan(ctx context.Context, results api.FinishedScanClientJob) error {
+	start := time.Now()
+	maxElapsed := time.Duration(scanner.config.Scanner.FinishScanMaxElapsed) * time.Second
+	backoff := time.Duration(0)
+
+	maxAttempts := scanner.config.Scanner.FinishScanMaxAttempts
+	if maxAttempts <= 0 {
+		log.Warnf("Scanner.FinishScanMaxAttempts is %d, defaulting to 1 attempt", maxAttempts)
+		maxAttempts = 1
+	}
+
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		err := scanner.postFinishedScan(ctx, results)
+		if err == nil {
+			return nil
+		}
+		log.Errorf("attempt %d/%d to finish scan job for %s failed: %s", attempt, maxAttempts, results.ImageSpec.Sha, err.Error())
+
+		if time.Since(start) >= maxElapsed {
+			break
+		}
+
+		backoff = decorrelatedJitterBackoff(backoff)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("cancelled while retrying finished scan job for %s", results.ImageSpec.Sha)
+		case <-time.After(backoff):
+		}
+	}
+
+	if dlErr := scanner.deadLetter(results); dlErr != nil {
+		log.Errorf("unable to dead-letter finished job for %s: %s", results.ImageSpec.Sha, dlErr.Error())
+		return dlErr
+	}
+	return fmt.Errorf("unable to post finished scan job for %s, dead-lettered after exhausting retries", results.ImageSpec.Sha)
+}
+
+// postFinishedScan makes a single attempt to report a finished job to
+// perceptor.
+func (scanner *Scanner) postFinishedScan(ctx context.Context, results api.FinishedScanClientJob) error {
 	finishedScanURL := scanner.buildURL(api.FinishedScanPath)
 	jsonBytes, err := json.Marshal(results)
 	if err != nil {
@@ -214,26 +490,25 @@ func (scanner *Scanner) finishScan(results api.FinishedScanClientJob) error {
 	}
 
 	log.Debugf("about to send over json text for finishing a job: %s", string(jsonBytes))
-	// TODO change to exponential backoff or something ... but don't loop indefinitely in production
-	for {
-		resp, err := scanner.httpClient.Post(finishedScanURL, "application/json", bytes.NewBuffer(jsonBytes))
-		if err != nil {
-			recordScannerError("unable to POST finished job")
-			log.Errorf("unable to POST to %s: %s", finishedScanURL, err.Error())
-			continue
-		}
-
-		recordHTTPStats(api.FinishedScanPath, resp.StatusCode)
-
-		defer resp.Body.Close()
-		if resp.StatusCode != 200 {
-			log.Errorf("POST to %s failed with status code %d", finishedScanURL, resp.StatusCode)
-			continue
-		}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, finishedScanURL, bytes.NewBuffer(jsonBytes))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := scanner.httpClient.Do(req)
+	if err != nil {
+		recordScannerError("unable to POST finished job")
+		return fmt.Errorf("unable to POST to %s: %s", finishedScanURL, err.Error())
+	}
+	defer resp.Body.Close()
 
-		log.Infof("POST to %s succeeded", finishedScanURL)
-		return nil
+	recordHTTPStats(api.FinishedScanPath, resp.StatusCode)
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("POST to %s failed with status code %d", finishedScanURL, resp.StatusCode)
 	}
+
+	log.Infof("POST to %s succeeded", finishedScanURL)
+	return nil
 }
 
 func (scanner *Scanner) buildURL(path string) string {